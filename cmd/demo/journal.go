@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -15,11 +16,17 @@ func main() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	defer lg.Close()
 
 	lg.AddVariable("FOO", "bar")
 	lg.Infof("starting")
 	runTest(lg)
-	time.Sleep(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := lg.Flush(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
 }
 
 func runTest(lg lwlog.Logger) {
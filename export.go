@@ -0,0 +1,74 @@
+package lwjournal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// JournalExportWriter writes log messages in the systemd Journal Export
+// Format (as documented at
+// https://systemd.io/JOURNAL_EXPORT_FORMATS/#journal-export-format) to an
+// arbitrary io.Writer, rather than to the local journal socket. This is
+// useful for capturing logs to a file for later replay with
+// systemd-journal-remote, or for shipping them to a remote journald over
+// HTTPS. It implements the lwlog.Logger interface.
+type JournalExportWriter struct {
+	// Debug may be set to true to enable writing of debug level messages.
+	Debug bool
+
+	w   io.Writer
+	wmu sync.Mutex
+	pri map[int][]byte
+
+	codePos codePosCache
+}
+
+// NewExportWriter returns a JournalExportWriter that writes entries to w.
+func NewExportWriter(w io.Writer) *JournalExportWriter {
+	return &JournalExportWriter{
+		w: w,
+		pri: map[int][]byte{
+			7: buildField("PRIORITY", "7"),
+			6: buildField("PRIORITY", "6"),
+			3: buildField("PRIORITY", "3"),
+		},
+	}
+}
+
+// Debugf writes debug log messages. The message will only be written if
+// w.Debug is true.
+func (w *JournalExportWriter) Debugf(fmt string, args ...interface{}) {
+	if !w.Debug {
+		return
+	}
+	w.entry(7, fmt, args...)
+}
+
+// Infof writes a log message.
+func (w *JournalExportWriter) Infof(fmt string, args ...interface{}) {
+	w.entry(6, fmt, args...)
+}
+
+// Errorf writes an error log message.
+func (w *JournalExportWriter) Errorf(fmt string, args ...interface{}) {
+	w.entry(3, fmt, args...)
+}
+
+func (w *JournalExportWriter) entry(priority int, Fmt string, args ...interface{}) {
+	codePos := w.codePos.get(3)
+
+	msg := bytes.NewBuffer(make([]byte, 0, 80))
+	fmt.Fprintf(msg, Fmt, args...)
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(codePos)+msg.Len()+40))
+	buf.Write(w.pri[priority])
+	buf.Write(codePos)
+	writeField(buf, "MESSAGE", msg.Bytes())
+	buf.WriteByte('\n') // blank line separates entries
+
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	_, _ = w.w.Write(buf.Bytes())
+}
@@ -0,0 +1,201 @@
+package lwjournal
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lwithers/lwlog"
+)
+
+// Priority is a journald log priority, as per syslog(3): 0 is emergency, 7
+// is debug.
+type Priority int
+
+// Priorities understood by Journal.Log. These correspond to the levels
+// already used by Debugf, Infof and Errorf.
+const (
+	PriorityDebug Priority = 7
+	PriorityInfo  Priority = 6
+	PriorityError Priority = 3
+)
+
+// Field is a single piece of structured, typed context to attach to a log
+// entry. Construct one with String, Int, Err, Duration, Bytes or Any.
+type Field struct {
+	name  string
+	value []byte
+}
+
+// String returns a Field holding a string value.
+func String(name, value string) Field {
+	return Field{name: sanitizeFieldName(name), value: []byte(value)}
+}
+
+// Int returns a Field holding an integer value.
+func Int(name string, value int) Field {
+	return Field{
+		name:  sanitizeFieldName(name),
+		value: strconv.AppendInt(nil, int64(value), 10),
+	}
+}
+
+// Err returns a Field named ERROR holding err's message. If err is nil, the
+// field holds an empty value.
+func Err(err error) Field {
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+	return Field{name: "ERROR", value: []byte(msg)}
+}
+
+// Duration returns a Field holding a duration, formatted as per
+// time.Duration.String.
+func Duration(name string, d time.Duration) Field {
+	return Field{name: sanitizeFieldName(name), value: []byte(d.String())}
+}
+
+// Bytes returns a Field holding a raw byte slice. Values containing NUL
+// bytes or invalid UTF-8 are transparently written using journald's binary
+// field encoding.
+func Bytes(name string, value []byte) Field {
+	return Field{name: sanitizeFieldName(name), value: value}
+}
+
+// Any returns a Field holding fmt.Sprint(value).
+func Any(name string, value interface{}) Field {
+	return Field{name: sanitizeFieldName(name), value: []byte(fmt.Sprint(value))}
+}
+
+// maxFieldNameLen is journald's limit on the length of a field name.
+const maxFieldNameLen = 64
+
+// sanitizeFieldName rewrites name to satisfy journald's constraints on
+// field names: it must consist solely of uppercase letters, digits and
+// underscores, must not start with a digit or underscore, and must be no
+// more than 64 bytes long.
+func sanitizeFieldName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(name) {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	out := strings.TrimLeft(b.String(), "_0123456789")
+	if len(out) > maxFieldNameLen {
+		out = out[:maxFieldNameLen]
+	}
+	if out == "" {
+		out = "FIELD"
+	}
+	return out
+}
+
+// Log writes a log entry at the given priority with the given fields
+// attached, complementing the printf-style Debugf/Infof/Errorf with
+// structured, per-entry context.
+func (j *Journal) Log(priority Priority, msg string, fields ...Field) {
+	if priority == PriorityDebug && !j.Debug {
+		return
+	}
+	j.logEntry(j.priorityPreamble(priority), msg, fields)
+}
+
+func (j *Journal) priorityPreamble(p Priority) []byte {
+	switch p {
+	case PriorityDebug:
+		return j.priDebug
+	case PriorityInfo:
+		return j.priInfo
+	case PriorityError:
+		return j.priError
+	default:
+		return buildField("PRIORITY", strconv.Itoa(int(p)))
+	}
+}
+
+// logEntry assembles and enqueues an entry from an already-formatted
+// preamble, a plain message and a set of structured fields.
+func (j *Journal) logEntry(preamble []byte, msg string, fields []Field) {
+	codePos := j.codePos.get(3)
+	extraVars := j.snapshotExtraVars()
+
+	buf := bytes.NewBuffer(make([]byte, 0,
+		len(preamble)+len(codePos)+len(extraVars)+len(msg)+64))
+	buf.Write(preamble)
+	buf.Write(codePos)
+	buf.Write(extraVars)
+	writeField(buf, "MESSAGE", []byte(msg))
+	for _, f := range fields {
+		writeField(buf, f.name, f.value)
+	}
+
+	atomic.AddUint64(&j.entries, 1)
+	j.enqueue(buf.Bytes())
+}
+
+// With returns a logger that behaves like j, except that fields are
+// prepended to every entry it writes. Unlike AddVariable, this does not
+// mutate j or affect other loggers derived from it.
+func (j *Journal) With(fields ...Field) lwlog.Logger {
+	extra := bytes.NewBuffer(nil)
+	for _, f := range fields {
+		writeField(extra, f.name, f.value)
+	}
+	return &childLogger{parent: j, extra: extra.Bytes()}
+}
+
+// childLogger is the lwlog.Logger returned by Journal.With: it shares its
+// parent's connection, drop policy and counters, but prepends a fixed set
+// of fields to every entry.
+type childLogger struct {
+	parent *Journal
+	extra  []byte
+}
+
+// Debugf writes debug log messages. The message will only be written if
+// the parent Journal's Debug is true.
+func (c *childLogger) Debugf(fmt string, args ...interface{}) {
+	if !c.parent.Debug {
+		return
+	}
+	c.entry(c.parent.priDebug, fmt, args...)
+}
+
+// Infof writes a log message.
+func (c *childLogger) Infof(fmt string, args ...interface{}) {
+	c.entry(c.parent.priInfo, fmt, args...)
+}
+
+// Errorf writes an error log message.
+func (c *childLogger) Errorf(fmt string, args ...interface{}) {
+	c.entry(c.parent.priError, fmt, args...)
+}
+
+func (c *childLogger) entry(preamble []byte, Fmt string, args ...interface{}) {
+	j := c.parent
+	codePos := j.codePos.get(3)
+	extraVars := j.snapshotExtraVars()
+
+	msg := bytes.NewBuffer(make([]byte, 0, 80))
+	fmt.Fprintf(msg, Fmt, args...)
+
+	buf := bytes.NewBuffer(make([]byte, 0,
+		len(preamble)+len(codePos)+len(c.extra)+len(extraVars)+msg.Len()+20))
+	buf.Write(preamble)
+	buf.Write(codePos)
+	buf.Write(c.extra)
+	buf.Write(extraVars)
+	writeField(buf, "MESSAGE", msg.Bytes())
+
+	atomic.AddUint64(&j.entries, 1)
+	j.enqueue(buf.Bytes())
+}
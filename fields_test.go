@@ -0,0 +1,28 @@
+package lwjournal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFieldName(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"already valid", "FOO_BAR", "FOO_BAR"},
+		{"lowercase", "foo", "FOO"},
+		{"leading digit", "1FOO", "FOO"},
+		{"leading underscore", "_FOO", "FOO"},
+		{"invalid characters", "foo-bar.baz", "FOO_BAR_BAZ"},
+		{"empty", "", "FIELD"},
+		{"only digits and underscores", "_123_", "FIELD"},
+		{"too long", strings.Repeat("A", 100), strings.Repeat("A", maxFieldNameLen)},
+	}
+	for _, c := range cases {
+		if got := sanitizeFieldName(c.in); got != c.want {
+			t.Errorf("%s: sanitizeFieldName(%q) = %q, want %q", c.name, c.in, got, c.want)
+		}
+	}
+}
@@ -7,38 +7,87 @@ package lwjournal
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"unicode/utf8"
 
 	"github.com/lwithers/lwlog"
 )
 
-// Journal writes log messages to systemd's journal. The output is asynchronous,
-// so you will need a short delay before exiting the program to ensure all
-// messages are flushed correctly.
+// largeMessageThreshold is the default value of Journal.LargeMessageThreshold:
+// entries above this size are sent via the memfd fallback up front, rather
+// than waiting to be rejected with EMSGSIZE, since the socket's SO_SNDBUF
+// is often much smaller than journald's own 8 MiB entry limit.
+const largeMessageThreshold = 8 * 1024
+
+// Journal writes log messages to systemd's journal. The output is
+// asynchronous; call Flush or Close before exiting the program to ensure all
+// messages are written.
 type Journal struct {
 	// Debug may be set to true to enable writing of debug level messages.
 	Debug bool
 
+	// LargeMessageThreshold sets the entry size, in bytes, above which
+	// entries are sent via the memfd/SCM_RIGHTS fallback rather than
+	// directly over the journal socket. It defaults to 8 KiB.
+	LargeMessageThreshold int
+
+	// DropPolicy controls what happens when the writer can't keep up
+	// with the rate of log calls. It defaults to BlockingMode.
+	DropPolicy DropPolicy
+
 	// connection to the journal
-	sock net.Conn
+	sock *net.UnixConn
 
 	// ready-formatted fields used to construct log entries
 	priDebug, priInfo, priError []byte
 	extraVars                   *bytes.Buffer
+	extraVarsLock               sync.RWMutex
+
+	codePos codePosCache
 
-	// map of program counters onto CODE_FILE, CODE_LINE etc. fields ready
-	// to be used to construct log entries
-	codePos     map[uintptr][]byte
-	codePosLock sync.RWMutex
+	writes     chan []byte
+	writerDone chan struct{}
+	stopReport chan struct{}
+	reportDone chan struct{}
 
-	writes chan []byte
+	entries, dropped, bytesWritten, lastReportedDrops uint64
+
+	// pending counts entries that have been accepted by enqueue but not
+	// yet either dropped or fully written by the writer goroutine; Flush
+	// waits for it to reach zero.
+	pending int64
+
+	// closeMu guards closed and, transitively, j.writes: enqueue holds a
+	// read lock around its send so that Close (which takes the write
+	// lock before closing j.writes) can never race a concurrent logging
+	// call into a "send on closed channel" panic.
+	closeMu sync.RWMutex
+	closed  bool
 }
 
+// writeField serialises a single field in the systemd Journal Export
+// Format: "NAME=VALUE\n" when the value is valid UTF-8 and free of control
+// characters (other than tab), or the binary form ("NAME\n" followed by an
+// 8-byte little-endian length, the raw value, and a trailing newline)
+// otherwise. This is also the wire format accepted by journald's native
+// socket protocol, so the same function serves both Journal and
+// JournalExportWriter.
 func writeField(b *bytes.Buffer, name string, message []byte) {
+	if isTextSafe(message) {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.Write(message)
+		b.WriteByte('\n')
+		return
+	}
+
 	var sz [8]byte
 	binary.LittleEndian.PutUint64(sz[:], uint64(len(message)))
 
@@ -49,6 +98,24 @@ func writeField(b *bytes.Buffer, name string, message []byte) {
 	b.WriteByte('\n')
 }
 
+// isTextSafe reports whether message may be written using the plain
+// "NAME=VALUE\n" form: it must be valid UTF-8 and contain no control
+// characters other than tab (in particular, no embedded newline).
+func isTextSafe(message []byte) bool {
+	if !utf8.Valid(message) {
+		return false
+	}
+	for _, r := range string(message) {
+		if r == '\t' {
+			continue
+		}
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 func buildField(name, message string) []byte {
 	b := bytes.NewBuffer(make([]byte, 0, len(name)+len(message)+10))
 	writeField(b, name, []byte(message))
@@ -58,30 +125,48 @@ func buildField(name, message string) []byte {
 // New returns a new journal. It may return an error if it is unable to connect
 // to the running journal daemon.
 func New() (*Journal, error) {
-	sock, err := net.Dial("unixgram", "/run/systemd/journal/socket")
+	sock, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: "/run/systemd/journal/socket", Net: "unixgram"})
 	if err != nil {
 		return nil, err
 	}
 
 	j := &Journal{
-		sock:      sock,
-		priDebug:  buildField("PRIORITY", "7"),
-		priInfo:   buildField("PRIORITY", "6"),
-		priError:  buildField("PRIORITY", "3"),
-		extraVars: bytes.NewBuffer(nil),
-		codePos:   make(map[uintptr][]byte),
-		writes:    make(chan []byte, 100),
+		sock:                  sock,
+		LargeMessageThreshold: largeMessageThreshold,
+		priDebug:              buildField("PRIORITY", "7"),
+		priInfo:               buildField("PRIORITY", "6"),
+		priError:              buildField("PRIORITY", "3"),
+		extraVars:             bytes.NewBuffer(nil),
+		writes:                make(chan []byte, 100),
+		writerDone:            make(chan struct{}),
+		stopReport:            make(chan struct{}),
+		reportDone:            make(chan struct{}),
 	}
 	go j.writer()
+	go j.reportDropsLoop()
 	return j, nil
 }
 
 // AddVariable adds a value into each log message that is written. This could be
-// used if you have some sort of session or instance identifier.
+// used if you have some sort of session or instance identifier. It is safe to
+// call concurrently with logging calls and with itself.
 func (j *Journal) AddVariable(name, value string) {
+	j.extraVarsLock.Lock()
+	defer j.extraVarsLock.Unlock()
 	writeField(j.extraVars, name, []byte(value))
 }
 
+// snapshotExtraVars returns a copy of the currently registered extra
+// variables, safe to use without holding extraVarsLock.
+func (j *Journal) snapshotExtraVars() []byte {
+	j.extraVarsLock.RLock()
+	defer j.extraVarsLock.RUnlock()
+	extra := make([]byte, j.extraVars.Len())
+	copy(extra, j.extraVars.Bytes())
+	return extra
+}
+
 // Debugf writes debug log messages. The message will only be written if j.Debug
 // is true.
 func (j *Journal) Debugf(fmt string, args ...interface{}) {
@@ -102,36 +187,121 @@ func (j *Journal) Errorf(fmt string, args ...interface{}) {
 }
 
 func (j *Journal) entry(preamble []byte, Fmt string, args ...interface{}) {
-	codePos := j.getCodePos()
+	codePos := j.codePos.get(3)
 
 	msg := bytes.NewBuffer(make([]byte, 0, 80))
 	fmt.Fprintf(msg, Fmt, args...)
 
-	reqLen := len(preamble) + len(codePos) + j.extraVars.Len() +
+	extraVars := j.snapshotExtraVars()
+	reqLen := len(preamble) + len(codePos) + len(extraVars) +
 		msg.Len() + 20
 
 	buf := bytes.NewBuffer(make([]byte, 0, reqLen))
 	buf.Write(preamble)
 	buf.Write(codePos)
-	buf.Write(j.extraVars.Bytes())
+	buf.Write(extraVars)
 	writeField(buf, "MESSAGE", msg.Bytes())
 
-	j.writes <- buf.Bytes()
+	atomic.AddUint64(&j.entries, 1)
+	j.enqueue(buf.Bytes())
+}
+
+// enqueue hands msg to the writer goroutine, applying DropPolicy if the
+// writes channel is full. It increments pending for every msg accepted
+// here, whether or not it is later dropped; the writer goroutine
+// decrements it once msg has been fully written (see writer). Flush uses
+// pending to know when every enqueued entry has actually been dealt with.
+//
+// It holds closeMu for reading for the duration of the send, so that Close
+// can't close j.writes out from under a concurrent logging call.
+func (j *Journal) enqueue(msg []byte) {
+	j.closeMu.RLock()
+	defer j.closeMu.RUnlock()
+	if j.closed {
+		// the journal has been closed; there's nowhere left to send this
+		atomic.AddUint64(&j.dropped, 1)
+		return
+	}
+
+	atomic.AddInt64(&j.pending, 1)
+
+	switch j.DropPolicy {
+	case DropNewest:
+		select {
+		case j.writes <- msg:
+		default:
+			atomic.AddUint64(&j.dropped, 1)
+			atomic.AddInt64(&j.pending, -1)
+		}
+
+	case DropOldest:
+		for {
+			select {
+			case j.writes <- msg:
+				return
+			default:
+			}
+			select {
+			case <-j.writes:
+				atomic.AddUint64(&j.dropped, 1)
+				atomic.AddInt64(&j.pending, -1)
+			default:
+			}
+		}
+
+	default: // BlockingMode
+		j.writes <- msg
+	}
 }
 
 func (j *Journal) writer() {
 	for msg := range j.writes {
-		// we can't do anything much about errors, but perhaps we should
-		// detect the case that the journal daemon was shut down
-		_, _ = j.sock.Write(msg)
+		j.send(msg)
+		atomic.AddInt64(&j.pending, -1)
 	}
+	close(j.writerDone)
 }
 
-func (j *Journal) getCodePos() []byte {
+// send writes msg to the journal socket, falling back to passing a sealed
+// memfd over SCM_RIGHTS when msg is too large for a single datagram (or
+// when it's known up front to be, per LargeMessageThreshold).
+func (j *Journal) send(msg []byte) {
+	if len(msg) <= j.LargeMessageThreshold {
+		_, err := j.sock.Write(msg)
+		if err == nil {
+			atomic.AddUint64(&j.bytesWritten, uint64(len(msg)))
+			return
+		}
+		if !errors.Is(err, syscall.EMSGSIZE) {
+			// failed for a reason that retrying via memfd won't fix
+			return
+		}
+	}
+
+	// we can't do much about an error here either, but perhaps we should
+	// detect the case that the journal daemon was shut down
+	if sendViaMemfd(j.sock, msg) == nil {
+		atomic.AddUint64(&j.bytesWritten, uint64(len(msg)))
+	}
+}
+
+// codePosCache maps program counters onto ready-formatted CODE_FILE,
+// CODE_LINE and CODE_FUNC fields, so that repeated log calls from the same
+// call site don't repeatedly re-serialise the same values. It is shared by
+// Journal and JournalExportWriter.
+type codePosCache struct {
+	m    map[uintptr][]byte
+	lock sync.RWMutex
+}
+
+// get returns the code position fields for the caller found skip frames up
+// the stack (as per runtime.Callers), walking further up past any logging
+// helper functions recognised by lwlog.IsLoggingFunction.
+func (c *codePosCache) get(skip int) []byte {
 	// walk back over the stack (at most 4 entries) until we hit the first
 	// non-logging function
 	pc := make([]uintptr, 4)
-	runtime.Callers(3, pc) // skip getCodePos and Journal.Debugf/Infof/etc.
+	runtime.Callers(skip, pc)
 	frames := runtime.CallersFrames(pc)
 	frame, moreFrames := frames.Next()
 	for moreFrames && lwlog.IsLoggingFunction(frame.Func) {
@@ -140,9 +310,9 @@ func (j *Journal) getCodePos() []byte {
 
 	// use the PC as the key to look up the code location message in our
 	// cache
-	j.codePosLock.RLock()
-	codePos, known := j.codePos[frame.PC]
-	j.codePosLock.RUnlock()
+	c.lock.RLock()
+	codePos, known := c.m[frame.PC]
+	c.lock.RUnlock()
 	if known {
 		return codePos
 	}
@@ -158,9 +328,12 @@ func (j *Journal) getCodePos() []byte {
 	// update the cache (NB: it's possible that another goroutine could
 	// also have passed into or through the above lock in the meantime,
 	// but that's fine — it will just write the same result into the map).
-	j.codePosLock.Lock()
-	j.codePos[frame.PC] = codePos
-	j.codePosLock.Unlock()
+	c.lock.Lock()
+	if c.m == nil {
+		c.m = make(map[uintptr][]byte)
+	}
+	c.m[frame.PC] = codePos
+	c.lock.Unlock()
 
 	return codePos
 }
@@ -0,0 +1,56 @@
+package lwjournal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWriteFieldText(t *testing.T) {
+	var buf bytes.Buffer
+	writeField(&buf, "FOO", []byte("bar"))
+
+	want := "FOO=bar\n"
+	if got := buf.String(); got != want {
+		t.Errorf("writeField text form = %q, want %q", got, want)
+	}
+}
+
+func TestWriteFieldBinary(t *testing.T) {
+	value := []byte("line one\nline two")
+
+	var buf bytes.Buffer
+	writeField(&buf, "FOO", value)
+
+	var want bytes.Buffer
+	want.WriteString("FOO\n")
+	var sz [8]byte
+	binary.LittleEndian.PutUint64(sz[:], uint64(len(value)))
+	want.Write(sz[:])
+	want.Write(value)
+	want.WriteByte('\n')
+
+	if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+		t.Errorf("writeField binary form = %q, want %q", buf.Bytes(), want.Bytes())
+	}
+}
+
+func TestIsTextSafe(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []byte
+		want bool
+	}{
+		{"plain ascii", []byte("hello world"), true},
+		{"contains tab", []byte("a\tb"), true},
+		{"embedded newline", []byte("a\nb"), false},
+		{"invalid utf8", []byte{0xff, 0xfe}, false},
+		{"other control char", []byte("a\x01b"), false},
+		{"empty", []byte(""), true},
+	}
+	for _, c := range cases {
+		if got := isTextSafe(c.in); got != c.want {
+			t.Errorf("%s: isTextSafe(%q) = %v, want %v", c.name, c.in, got, c.want)
+		}
+	}
+}
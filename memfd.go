@@ -0,0 +1,113 @@
+package lwjournal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sendViaMemfd implements journald's documented fallback for entries too
+// large to fit in a single datagram: the serialised fields are written to
+// a sealed memfd (or, on kernels predating memfd_create, an unlinked
+// O_TMPFILE), and the file descriptor is passed to the journal over an
+// otherwise-empty datagram using SCM_RIGHTS. journald detects the empty
+// payload and reads the entry from the passed file descriptor instead.
+func sendViaMemfd(conn *net.UnixConn, data []byte) error {
+	f, err := createSealedEntryFile(data)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rights := unix.UnixRights(int(f.Fd()))
+
+	// conn is connected (New dials the journal socket), and the net
+	// package's WriteMsgUnix unconditionally refuses to write to a
+	// connected SOCK_DGRAM conn even with a nil address, so the fd has to
+	// be handed over with a raw sendmsg(2) via SyscallConn instead.
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("lwjournal: raw conn: %w", err)
+	}
+	var sendErr error
+	err = rc.Write(func(fd uintptr) bool {
+		sendErr = unix.Sendmsg(int(fd), nil, rights, nil, 0)
+		return sendErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return fmt.Errorf("lwjournal: send entry fd: %w", err)
+	}
+	if sendErr != nil {
+		return fmt.Errorf("lwjournal: send entry fd: %w", sendErr)
+	}
+	return nil
+}
+
+// createSealedEntryFile writes data to a memfd sealed against further
+// modification, so that journald can safely mmap it after we hand over the
+// descriptor.
+func createSealedEntryFile(data []byte) (*os.File, error) {
+	fd, err := unix.MemfdCreate("lwjournal-entry", unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		// kernel predates memfd_create (pre-3.17): fall back to an
+		// unlinked tmpfile, which can't be sealed but is otherwise
+		// equivalent for our purposes.
+		return createTmpfileEntryFile(data)
+	}
+
+	f := os.NewFile(uintptr(fd), "lwjournal-entry")
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lwjournal: write memfd entry: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lwjournal: seek memfd entry: %w", err)
+	}
+
+	const seals = unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, seals); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lwjournal: seal memfd entry: %w", err)
+	}
+
+	return f, nil
+}
+
+// createTmpfileEntryFile is the fallback used when memfd_create is
+// unavailable: an unlinked file created with O_TMPFILE in /dev/shm (or,
+// failing that, /tmp), which never appears in any directory listing and is reclaimed once the last fd
+// referencing it is closed.
+func createTmpfileEntryFile(data []byte) (*os.File, error) {
+	var (
+		fd      int
+		lastErr error
+	)
+	for _, dir := range []string{"/dev/shm", "/tmp"} {
+		var err error
+		fd, err = unix.Open(dir, unix.O_TMPFILE|unix.O_RDWR, 0600)
+		if err == nil {
+			lastErr = nil
+			break
+		}
+		lastErr = err
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("lwjournal: create fallback tmpfile: %w", lastErr)
+	}
+
+	f := os.NewFile(uintptr(fd), "lwjournal-entry")
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lwjournal: write tmpfile entry: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lwjournal: seek tmpfile entry: %w", err)
+	}
+	return f, nil
+}
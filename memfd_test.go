@@ -0,0 +1,107 @@
+package lwjournal
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCreateSealedEntryFileRoundTrip(t *testing.T) {
+	data := []byte("FOO=bar\nMESSAGE\x00binary payload\n")
+
+	f, err := createSealedEntryFile(data)
+	if err != nil {
+		t.Fatalf("createSealedEntryFile: %v", err)
+	}
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading back entry file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("entry file contents = %q, want %q", got, data)
+	}
+
+	// F_GET_SEALS only succeeds on a memfd; on kernels old enough to need
+	// the O_TMPFILE fallback there's nothing to seal, so a failure here
+	// just means the fallback path was exercised instead.
+	seals, err := unix.FcntlInt(f.Fd(), unix.F_GET_SEALS, 0)
+	if err != nil {
+		t.Logf("F_GET_SEALS failed (expected on the O_TMPFILE fallback path): %v", err)
+		return
+	}
+	const want = unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE
+	if seals&want != want {
+		t.Errorf("seals = %#x, want at least %#x", seals, want)
+	}
+
+	// sealed against further writes
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Errorf("write to sealed memfd unexpectedly succeeded")
+	}
+}
+
+func TestSendRoutesOversizedEntriesViaMemfd(t *testing.T) {
+	addr := &net.UnixAddr{Net: "unixgram", Name: filepath.Join(t.TempDir(), "sock")}
+
+	server, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatalf("ListenUnixgram: %v", err)
+	}
+	defer server.Close()
+
+	client, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatalf("DialUnix: %v", err)
+	}
+	defer client.Close()
+
+	j := &Journal{sock: client, LargeMessageThreshold: 16}
+
+	msg := bytes.Repeat([]byte("x"), 64)
+	j.send(msg)
+
+	if err := server.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	payload := make([]byte, 4)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := server.ReadMsgUnix(payload, oob)
+	if err != nil {
+		t.Fatalf("ReadMsgUnix: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("datagram payload length = %d, want 0 (fd should carry the entry)", n)
+	}
+
+	scms, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(scms) != 1 {
+		t.Fatalf("ParseSocketControlMessage: %d messages, err %v", len(scms), err)
+	}
+	fds, err := unix.ParseUnixRights(&scms[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("ParseUnixRights: %d fds, err %v", len(fds), err)
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "received-entry")
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading received entry: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("received entry = %q, want %q", got, msg)
+	}
+
+	if got := j.Stats().BytesWritten; got != uint64(len(msg)) {
+		t.Errorf("BytesWritten = %d, want %d", got, len(msg))
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Package reader provides read access to the systemd journal, complementing
+lwjournal's write-only Journal type. It is mainly useful for tests and
+in-process log viewers that need to round-trip entries written via
+lwjournal.Journal.
+*/
+package reader
+
+/*
+#cgo pkg-config: libsystemd
+#include <systemd/sd-journal.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// pollTimeout bounds how long a single call to sd_journal_wait blocks, so
+// that Next can notice context cancellation promptly even while idle.
+const pollTimeout = time.Second
+
+// Entry is a single log entry read back from the journal.
+type Entry struct {
+	Timestamp time.Time
+	Priority  int
+	Message   string
+	CodeFile  string
+	CodeLine  string
+	CodeFunc  string
+
+	// Cursor identifies this entry's position in the journal. It may be
+	// passed to SeekCursor to resume reading from this point later.
+	Cursor string
+
+	// Fields holds every field of the entry, including MESSAGE,
+	// PRIORITY, CODE_FILE etc.
+	Fields map[string]string
+}
+
+// Reader reads entries from the systemd journal.
+type Reader struct {
+	j *C.sd_journal
+}
+
+// Option configures a Reader at Open time.
+type Option func(*Reader) error
+
+// Open opens the local systemd journal for reading.
+func Open(opts ...Option) (*Reader, error) {
+	var j *C.sd_journal
+	if ret := C.sd_journal_open(&j, C.SD_JOURNAL_LOCAL_ONLY); ret < 0 {
+		return nil, journalErr("sd_journal_open", ret)
+	}
+
+	r := &Reader{j: j}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// SeekCursor seeks the reader to just after the position described by
+// cursor, as previously returned in Entry.Cursor. It is typically passed to
+// Open so that reading resumes where it last left off.
+func SeekCursor(cursor string) Option {
+	return func(r *Reader) error {
+		cs := C.CString(cursor)
+		defer C.free(unsafe.Pointer(cs))
+		if ret := C.sd_journal_seek_cursor(r.j, cs); ret < 0 {
+			return journalErr("sd_journal_seek_cursor", ret)
+		}
+		// the cursor points at an already-seen entry, so step past it
+		_, err := r.step()
+		return err
+	}
+}
+
+// Since seeks the reader to the first entry at or after t.
+func Since(t time.Time) Option {
+	return func(r *Reader) error {
+		ret := C.sd_journal_seek_realtime_usec(r.j, C.uint64_t(t.UnixMicro()))
+		if ret < 0 {
+			return journalErr("sd_journal_seek_realtime_usec", ret)
+		}
+		return nil
+	}
+}
+
+// Tail seeks the reader so that the next n entries returned by Next are the
+// last n entries currently present in the journal.
+func Tail(n int) Option {
+	return func(r *Reader) error {
+		if ret := C.sd_journal_seek_tail(r.j); ret < 0 {
+			return journalErr("sd_journal_seek_tail", ret)
+		}
+		// Next advances before reading, so step back one further than n;
+		// if the journal holds fewer entries than that, start from the
+		// head instead so that none of them is skipped.
+		skipped := C.sd_journal_previous_skip(r.j, C.uint64_t(n+1))
+		if skipped < 0 {
+			return journalErr("sd_journal_previous_skip", skipped)
+		}
+		if int(skipped) < n+1 {
+			if ret := C.sd_journal_seek_head(r.j); ret < 0 {
+				return journalErr("sd_journal_seek_head", ret)
+			}
+		}
+		return nil
+	}
+}
+
+// AddMatch restricts iteration to entries matching "FIELD=value". Among
+// matches added without an intervening AddDisjunction, those on different
+// fields are ANDed together and those on the same field are ORed; see
+// AddDisjunction to build OR groups.
+func (r *Reader) AddMatch(match string) error {
+	cs := C.CString(match)
+	defer C.free(unsafe.Pointer(cs))
+	if ret := C.sd_journal_add_match(r.j, unsafe.Pointer(cs), C.size_t(len(match))); ret < 0 {
+		return journalErr("sd_journal_add_match", ret)
+	}
+	return nil
+}
+
+// AddDisjunction inserts a logical OR between matches added before and
+// after this call.
+func (r *Reader) AddDisjunction() error {
+	if ret := C.sd_journal_add_disjunction(r.j); ret < 0 {
+		return journalErr("sd_journal_add_disjunction", ret)
+	}
+	return nil
+}
+
+// Next blocks until the next matching entry is available, ctx is
+// cancelled, or an error occurs. It uses the journal's inotify/timeout
+// wakeup mechanism rather than polling, so it is cheap to leave a Next call
+// running in its own goroutine.
+func (r *Reader) Next(ctx context.Context) (*Entry, error) {
+	for {
+		advanced, err := r.step()
+		if err != nil {
+			return nil, err
+		}
+		if advanced {
+			return r.readEntry()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		if ret := C.sd_journal_wait(r.j, C.uint64_t(pollTimeout/time.Microsecond)); ret < 0 {
+			return nil, journalErr("sd_journal_wait", ret)
+		}
+	}
+}
+
+// Close closes the reader's handle on the journal.
+func (r *Reader) Close() error {
+	C.sd_journal_close(r.j)
+	return nil
+}
+
+// step advances to the next matching entry, reporting whether one was
+// found.
+func (r *Reader) step() (bool, error) {
+	ret := C.sd_journal_next(r.j)
+	if ret < 0 {
+		return false, journalErr("sd_journal_next", ret)
+	}
+	return ret > 0, nil
+}
+
+// readEntry reads every field of the current entry, along with its
+// timestamp and cursor.
+func (r *Reader) readEntry() (*Entry, error) {
+	var usec C.uint64_t
+	if ret := C.sd_journal_get_realtime_usec(r.j, &usec); ret < 0 {
+		return nil, journalErr("sd_journal_get_realtime_usec", ret)
+	}
+
+	var cCursor *C.char
+	if ret := C.sd_journal_get_cursor(r.j, &cCursor); ret < 0 {
+		return nil, journalErr("sd_journal_get_cursor", ret)
+	}
+	defer C.free(unsafe.Pointer(cCursor))
+
+	fields := make(map[string]string)
+	C.sd_journal_restart_data(r.j)
+	var data unsafe.Pointer
+	var length C.size_t
+	for {
+		ret := C.sd_journal_enumerate_data(r.j, &data, &length)
+		if ret == 0 {
+			break
+		}
+		if ret < 0 {
+			return nil, journalErr("sd_journal_enumerate_data", ret)
+		}
+		if name, value, ok := bytes.Cut(C.GoBytes(data, C.int(length)), []byte("=")); ok {
+			fields[string(name)] = string(value)
+		}
+	}
+
+	e := &Entry{
+		Timestamp: time.UnixMicro(int64(usec)),
+		Cursor:    C.GoString(cCursor),
+		Message:   fields["MESSAGE"],
+		CodeFile:  fields["CODE_FILE"],
+		CodeLine:  fields["CODE_LINE"],
+		CodeFunc:  fields["CODE_FUNC"],
+		Fields:    fields,
+	}
+	if pri, err := strconv.Atoi(fields["PRIORITY"]); err == nil {
+		e.Priority = pri
+	}
+	return e, nil
+}
+
+// journalErr wraps a negative sd_journal_* return code (a negated errno)
+// into an error that identifies which call failed.
+func journalErr(call string, ret C.int) error {
+	return fmt.Errorf("%s: %w", call, syscall.Errno(-ret))
+}
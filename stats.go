@@ -0,0 +1,130 @@
+package lwjournal
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DropPolicy controls what a Journal does when its internal write queue is
+// full, i.e. when the writer goroutine can't keep up with the rate of
+// incoming log calls.
+type DropPolicy int
+
+const (
+	// BlockingMode makes Debugf/Infof/Errorf block until there is room
+	// in the queue. No entries are lost, but a stalled journal daemon
+	// can stall the whole program. This is the default.
+	BlockingMode DropPolicy = iota
+
+	// DropNewest discards the entry currently being logged if the queue
+	// is full.
+	DropNewest
+
+	// DropOldest discards the oldest queued entry to make room for the
+	// one currently being logged.
+	DropOldest
+)
+
+// dropReportInterval is how often a synthesized JOURNAL_DROPPED entry is
+// emitted while entries are being dropped.
+const dropReportInterval = 30 * time.Second
+
+// Stats is a snapshot of a Journal's counters, as returned by Stats.
+type Stats struct {
+	// Entries is the number of log calls made (Debugf calls that were
+	// suppressed by Debug being false are not counted).
+	Entries uint64
+
+	// Dropped is the number of entries discarded under DropNewest or
+	// DropOldest because the queue was full, plus any entries logged
+	// after Close.
+	Dropped uint64
+
+	// BytesWritten is the number of serialised entry bytes successfully
+	// handed to the journal, whether over the socket directly or via
+	// the memfd fallback.
+	BytesWritten uint64
+}
+
+// Stats returns a snapshot of the journal's counters.
+func (j *Journal) Stats() Stats {
+	return Stats{
+		Entries:      atomic.LoadUint64(&j.entries),
+		Dropped:      atomic.LoadUint64(&j.dropped),
+		BytesWritten: atomic.LoadUint64(&j.bytesWritten),
+	}
+}
+
+// reportDropsLoop periodically emits a synthesized JOURNAL_DROPPED entry
+// summarising drops since the last report, mirroring the way journald
+// itself reports its own rate-limit drops.
+func (j *Journal) reportDropsLoop() {
+	defer close(j.reportDone)
+	ticker := time.NewTicker(dropReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			j.reportDrops()
+		case <-j.stopReport:
+			return
+		}
+	}
+}
+
+func (j *Journal) reportDrops() {
+	total := atomic.LoadUint64(&j.dropped)
+	last := atomic.SwapUint64(&j.lastReportedDrops, total)
+	if total == last {
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(j.priError)
+	writeField(buf, "MESSAGE", []byte("journal writer dropped entries"))
+	writeField(buf, "JOURNAL_DROPPED", strconv.AppendUint(nil, total-last, 10))
+
+	// go through enqueue, like any other entry, so this respects
+	// DropPolicy instead of being able to block Close/Flush forever on a
+	// full queue under DropNewest/DropOldest.
+	j.enqueue(buf.Bytes())
+}
+
+// Flush blocks until every entry enqueued so far has actually been written
+// (or dropped), or ctx is done, whichever comes first. Unlike inferring
+// completion from the queue length, this also waits for the entry the
+// writer goroutine currently has in hand, which may still be serialising
+// into a memfd or blocked in a socket write.
+func (j *Journal) Flush(ctx context.Context) error {
+	for atomic.LoadInt64(&j.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// Close drains any queued entries, emits a final drop report if needed, and
+// closes the journal socket. It is safe to call concurrently with
+// Debugf/Infof/Errorf/Log from other goroutines: once Close has been
+// called, those calls discard their entries (counting them in
+// Stats.Dropped) instead of racing the channel close.
+// After Close returns, the Journal must not be used again.
+func (j *Journal) Close() error {
+	close(j.stopReport)
+	<-j.reportDone
+	j.reportDrops() // emit a final report for any drops since the last tick
+
+	j.closeMu.Lock()
+	j.closed = true
+	close(j.writes)
+	j.closeMu.Unlock()
+
+	<-j.writerDone
+	return j.sock.Close()
+}
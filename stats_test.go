@@ -0,0 +1,131 @@
+package lwjournal
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnqueueBlockingMode(t *testing.T) {
+	j := &Journal{writes: make(chan []byte, 1)}
+	j.enqueue([]byte("a"))
+
+	if got := len(j.writes); got != 1 {
+		t.Fatalf("channel len = %d, want 1", got)
+	}
+	if got := j.Stats().Dropped; got != 0 {
+		t.Fatalf("Dropped = %d, want 0", got)
+	}
+}
+
+func TestEnqueueDropNewest(t *testing.T) {
+	j := &Journal{DropPolicy: DropNewest, writes: make(chan []byte, 2)}
+	j.enqueue([]byte("a"))
+	j.enqueue([]byte("b"))
+	j.enqueue([]byte("c")) // queue is full; c should be dropped
+
+	if got := j.Stats().Dropped; got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+	if got, want := string(<-j.writes), "a"; got != want {
+		t.Fatalf("first queued entry = %q, want %q", got, want)
+	}
+	if got, want := string(<-j.writes), "b"; got != want {
+		t.Fatalf("second queued entry = %q, want %q", got, want)
+	}
+}
+
+func TestEnqueueDropOldest(t *testing.T) {
+	j := &Journal{DropPolicy: DropOldest, writes: make(chan []byte, 2)}
+	j.enqueue([]byte("a"))
+	j.enqueue([]byte("b"))
+	j.enqueue([]byte("c")) // queue is full; a (oldest) should be evicted
+
+	if got := j.Stats().Dropped; got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+	if got, want := string(<-j.writes), "b"; got != want {
+		t.Fatalf("first queued entry = %q, want %q", got, want)
+	}
+	if got, want := string(<-j.writes), "c"; got != want {
+		t.Fatalf("second queued entry = %q, want %q", got, want)
+	}
+}
+
+func TestEnqueueTracksPending(t *testing.T) {
+	j := &Journal{DropPolicy: DropNewest, writes: make(chan []byte, 1)}
+	j.enqueue([]byte("a"))
+	j.enqueue([]byte("b")) // dropped, so pending should drop back down
+
+	if got := j.pending; got != 1 {
+		t.Fatalf("pending = %d, want 1", got)
+	}
+}
+
+func TestEnqueueNoopAfterClosed(t *testing.T) {
+	j := &Journal{writes: make(chan []byte, 1)}
+
+	j.closeMu.Lock()
+	j.closed = true
+	j.closeMu.Unlock()
+
+	j.enqueue([]byte("a")) // must not panic, must not block
+
+	if got := len(j.writes); got != 0 {
+		t.Fatalf("channel len = %d, want 0", got)
+	}
+}
+
+// TestCloseNoRaceWithConcurrentLogging reproduces the scenario from the
+// review: one goroutine logging in a tight loop while another calls Close.
+// It must not panic with "send on closed channel".
+func TestCloseNoRaceWithConcurrentLogging(t *testing.T) {
+	addr := &net.UnixAddr{Net: "unixgram", Name: filepath.Join(t.TempDir(), "sock")}
+
+	server, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatalf("ListenUnixgram: %v", err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	client, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatalf("DialUnix: %v", err)
+	}
+
+	j := &Journal{
+		sock:                  client,
+		LargeMessageThreshold: largeMessageThreshold,
+		priInfo:               buildField("PRIORITY", "6"),
+		priError:              buildField("PRIORITY", "3"),
+		extraVars:             bytes.NewBuffer(nil),
+		writes:                make(chan []byte, 10),
+		writerDone:            make(chan struct{}),
+		stopReport:            make(chan struct{}),
+		reportDone:            make(chan struct{}),
+	}
+	go j.writer()
+	go j.reportDropsLoop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			j.Infof("entry %d", i)
+		}
+	}()
+
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	<-done
+}